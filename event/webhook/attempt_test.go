@@ -0,0 +1,99 @@
+// Copyright 2018 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	eventTypes "github.com/tsuru/tsuru/types/event"
+)
+
+// fakeWebHookStorage is a minimal in-memory eventTypes.WebHookStorage used
+// to exercise attemptDelivery without a real database.
+type fakeWebHookStorage struct {
+	hook       eventTypes.WebHook
+	deliveries map[string]eventTypes.WebHookDelivery
+}
+
+func (f *fakeWebHookStorage) Insert(eventTypes.WebHook) error { return nil }
+func (f *fakeWebHookStorage) Update(eventTypes.WebHook) error { return nil }
+func (f *fakeWebHookStorage) Delete(name string) error        { return nil }
+
+func (f *fakeWebHookStorage) FindByName(name string) (*eventTypes.WebHook, error) {
+	h := f.hook
+	return &h, nil
+}
+
+func (f *fakeWebHookStorage) FindAllByTeams(teams []string) ([]eventTypes.WebHook, error) {
+	return nil, nil
+}
+
+func (f *fakeWebHookStorage) FindByEvent(filter eventTypes.WebHookEventFilter, isSuccess bool) ([]eventTypes.WebHook, error) {
+	return nil, nil
+}
+
+func (f *fakeWebHookStorage) InsertDelivery(d eventTypes.WebHookDelivery) error {
+	f.deliveries[d.ID] = d
+	return nil
+}
+
+func (f *fakeWebHookStorage) UpdateDelivery(d eventTypes.WebHookDelivery) error {
+	f.deliveries[d.ID] = d
+	return nil
+}
+
+func (f *fakeWebHookStorage) FindDeliveryByID(id string) (*eventTypes.WebHookDelivery, error) {
+	d, ok := f.deliveries[id]
+	if !ok {
+		return nil, errors.New("delivery not found")
+	}
+	return &d, nil
+}
+
+func (f *fakeWebHookStorage) FindReadyDeliveries(now time.Time, limit int) ([]eventTypes.WebHookDelivery, error) {
+	return nil, nil
+}
+
+func (f *fakeWebHookStorage) FindDeliveriesByHook(hookName string) ([]eventTypes.WebHookDelivery, error) {
+	return nil, nil
+}
+
+// TestAttemptDeliveryDeadLettersWhileBreakerOpen guards against a durably
+// down endpoint looping its pending deliveries through the circuit-breaker
+// bypass forever: each skipped attempt must still count towards
+// retryMaxAttempts so the delivery eventually reaches the dead-letter
+// state, even though the breaker never lets a full HTTP attempt through.
+func TestAttemptDeliveryDeadLettersWhileBreakerOpen(t *testing.T) {
+	storage := &fakeWebHookStorage{
+		hook:       eventTypes.WebHook{Name: "myhook"},
+		deliveries: map[string]eventTypes.WebHookDelivery{},
+	}
+	s := &webHookService{storage: storage, dispatch: newDispatcher(nil)}
+	s.dispatch.runtimes["myhook"] = &hookRuntime{
+		breaker: &circuitBreaker{state: circuitOpen, openedAt: time.Now()},
+	}
+
+	d := eventTypes.WebHookDelivery{ID: "delivery-1", HookName: "myhook", State: eventTypes.WebHookDeliveryStatePending}
+	storage.deliveries[d.ID] = d
+
+	for i := 0; i < retryMaxAttempts; i++ {
+		current := storage.deliveries[d.ID]
+		if current.State == eventTypes.WebHookDeliveryStateDeadLetter {
+			t.Fatalf("delivery was dead-lettered early, after only %d attempts", i)
+		}
+		s.attemptDelivery(current)
+	}
+
+	final := storage.deliveries[d.ID]
+	if final.State != eventTypes.WebHookDeliveryStateDeadLetter {
+		t.Fatalf("expected delivery to be dead-lettered after %d breaker-open attempts, got state %q with %d attempts",
+			retryMaxAttempts, final.State, final.Attempts)
+	}
+	if final.Attempts != retryMaxAttempts {
+		t.Fatalf("expected Attempts to equal retryMaxAttempts (%d), got %d", retryMaxAttempts, final.Attempts)
+	}
+}
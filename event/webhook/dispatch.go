@@ -0,0 +1,207 @@
+// Copyright 2018 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/tsuru/tsuru/log"
+	eventTypes "github.com/tsuru/tsuru/types/event"
+)
+
+const (
+	defaultConcurrency = 1
+	dispatchQueueSize  = 100
+
+	circuitBreakerThreshold    = 5
+	circuitBreakerOpenDuration = 30 * time.Second
+)
+
+// circuitBreakerState enumerates the lifecycle of a circuitBreaker.
+type circuitBreakerState int
+
+const (
+	circuitClosed circuitBreakerState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker protects a single hook's endpoint from being hammered
+// once it starts failing: after circuitBreakerThreshold consecutive
+// failures it opens for circuitBreakerOpenDuration, then lets a single
+// probe through (half-open) to decide whether to close again.
+type circuitBreaker struct {
+	mu              sync.Mutex
+	state           circuitBreakerState
+	consecutiveFail int
+	openedAt        time.Time
+}
+
+// Allow reports whether a delivery attempt should proceed. It transitions
+// an open breaker to half-open once circuitBreakerOpenDuration has
+// elapsed, allowing a single probe attempt through.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < circuitBreakerOpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutiveFail = 0
+	b.state = circuitClosed
+}
+
+// RecordFailure reports a failed attempt, opening the breaker once
+// circuitBreakerThreshold consecutive failures have been observed. It
+// returns true when this failure caused the breaker to (re)open.
+func (b *circuitBreaker) RecordFailure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutiveFail++
+	if b.state == circuitHalfOpen || b.consecutiveFail >= circuitBreakerThreshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// hookRuntime holds the per-hook resources that bound and smooth out the
+// delivery attempts for a single webhook, so that one slow or broken
+// subscriber cannot starve unrelated hooks or amplify outages against
+// itself.
+type hookRuntime struct {
+	limiter *rate.Limiter
+	breaker *circuitBreaker
+	workCh  chan eventTypes.WebHookDelivery
+}
+
+// dispatcher fans deliveries out to a bounded worker pool per hook,
+// applying a token-bucket rate limit and circuit breaker before each call.
+type dispatcher struct {
+	process func(eventTypes.WebHookDelivery)
+
+	mu       sync.Mutex
+	runtimes map[string]*hookRuntime
+	inFlight map[string]bool
+}
+
+func newDispatcher(process func(eventTypes.WebHookDelivery)) *dispatcher {
+	return &dispatcher{
+		process:  process,
+		runtimes: make(map[string]*hookRuntime),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// Dispatch hands d to hook's worker pool, creating it on first use. It is
+// a no-op if d is already queued or being processed, which keeps the
+// periodic storage scan from piling up duplicate work for slow hooks.
+//
+// The runtime lookup and the channel send happen under the same lock as
+// Evict, so a concurrent hook delete/update can never close workCh out
+// from under a send in flight here.
+func (disp *dispatcher) Dispatch(hook eventTypes.WebHook, d eventTypes.WebHookDelivery) {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	if disp.inFlight[d.ID] {
+		return
+	}
+	rt, ok := disp.runtimes[hook.Name]
+	if !ok {
+		rt = disp.newRuntime(hook)
+		disp.runtimes[hook.Name] = rt
+	}
+	select {
+	case rt.workCh <- d:
+		disp.inFlight[d.ID] = true
+	default:
+		// worker pool is saturated, try again on the next scan tick.
+	}
+}
+
+// Breaker returns the circuit breaker tracking hookName, if a runtime has
+// been created for it yet.
+func (disp *dispatcher) Breaker(hookName string) *circuitBreaker {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	rt, ok := disp.runtimes[hookName]
+	if !ok {
+		return nil
+	}
+	return rt.breaker
+}
+
+// Evict tears down hookName's runtime, if one exists: its worker
+// goroutines drain whatever is left in workCh and exit once it is
+// closed. Call this when a hook is deleted (to stop leaking its
+// goroutines/channel) or updated (so the next Dispatch rebuilds the
+// runtime from the hook's current Concurrency/RatePerMinute/Burst
+// instead of keeping stale settings until a process restart).
+func (disp *dispatcher) Evict(hookName string) {
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	rt, ok := disp.runtimes[hookName]
+	if !ok {
+		return
+	}
+	delete(disp.runtimes, hookName)
+	close(rt.workCh)
+}
+
+func (disp *dispatcher) newRuntime(hook eventTypes.WebHook) *hookRuntime {
+	concurrency := hook.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	var limiter *rate.Limiter
+	if hook.RatePerMinute > 0 {
+		burst := hook.Burst
+		if burst <= 0 {
+			burst = hook.RatePerMinute
+		}
+		limiter = rate.NewLimiter(rate.Limit(float64(hook.RatePerMinute)/60.0), burst)
+	}
+	rt := &hookRuntime{
+		limiter: limiter,
+		breaker: &circuitBreaker{},
+		workCh:  make(chan eventTypes.WebHookDelivery, dispatchQueueSize),
+	}
+	for i := 0; i < concurrency; i++ {
+		go disp.worker(hook.Name, rt)
+	}
+	return rt
+}
+
+func (disp *dispatcher) worker(hookName string, rt *hookRuntime) {
+	for d := range rt.workCh {
+		if rt.limiter != nil {
+			if err := rt.limiter.Wait(context.Background()); err != nil {
+				log.Errorf("[webhooks] rate limiter wait failed for webhook %q: %v", hookName, err)
+			}
+		}
+		disp.process(d)
+		disp.mu.Lock()
+		delete(disp.inFlight, d.ID)
+		disp.mu.Unlock()
+	}
+}
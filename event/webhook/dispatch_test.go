@@ -0,0 +1,106 @@
+// Copyright 2018 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	eventTypes "github.com/tsuru/tsuru/types/event"
+)
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < circuitBreakerThreshold-1; i++ {
+		if opened := b.RecordFailure(); opened {
+			t.Fatalf("breaker opened after only %d failures, expected %d", i+1, circuitBreakerThreshold)
+		}
+		if !b.Allow() {
+			t.Fatalf("breaker should still allow attempts before reaching the threshold")
+		}
+	}
+	if opened := b.RecordFailure(); !opened {
+		t.Fatalf("expected breaker to open on the %dth consecutive failure", circuitBreakerThreshold)
+	}
+	if b.Allow() {
+		t.Fatalf("expected an open breaker to block attempts")
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	b := &circuitBreaker{
+		state:    circuitOpen,
+		openedAt: time.Now().Add(-circuitBreakerOpenDuration - time.Second),
+	}
+	if !b.Allow() {
+		t.Fatalf("expected a single probe to be allowed once the open duration has elapsed")
+	}
+	if b.Allow() {
+		t.Fatalf("expected only a single half-open probe to be allowed at a time")
+	}
+}
+
+func TestCircuitBreakerRecordSuccessCloses(t *testing.T) {
+	b := &circuitBreaker{}
+	for i := 0; i < circuitBreakerThreshold; i++ {
+		b.RecordFailure()
+	}
+	if b.Allow() {
+		t.Fatalf("expected breaker to be open")
+	}
+	b.state = circuitHalfOpen
+	b.RecordSuccess()
+	if !b.Allow() {
+		t.Fatalf("expected a closed breaker to allow attempts")
+	}
+}
+
+func TestDispatcherDispatchRunsEachDeliveryOnce(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]int{}
+	done := make(chan struct{}, 2)
+	disp := newDispatcher(func(d eventTypes.WebHookDelivery) {
+		mu.Lock()
+		seen[d.ID]++
+		mu.Unlock()
+		done <- struct{}{}
+	})
+	hook := eventTypes.WebHook{Name: "myhook", Concurrency: 1}
+	d := eventTypes.WebHookDelivery{ID: "delivery-1"}
+
+	disp.Dispatch(hook, d)
+	disp.Dispatch(hook, d) // duplicate while in flight, must be ignored
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for delivery to be processed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if seen["delivery-1"] != 1 {
+		t.Errorf("expected delivery-1 to be processed exactly once, got %d", seen["delivery-1"])
+	}
+}
+
+func TestDispatcherEvictStopsWorkers(t *testing.T) {
+	disp := newDispatcher(func(eventTypes.WebHookDelivery) {})
+	hook := eventTypes.WebHook{Name: "myhook"}
+	disp.Dispatch(hook, eventTypes.WebHookDelivery{ID: "delivery-1"})
+
+	// give the worker a chance to pick up the single queued delivery
+	// before we evict.
+	time.Sleep(50 * time.Millisecond)
+
+	disp.Evict(hook.Name)
+	if disp.Breaker(hook.Name) != nil {
+		t.Errorf("expected the evicted hook's runtime to be gone")
+	}
+	// dispatching again must transparently create a fresh runtime rather
+	// than panic on the torn-down one.
+	disp.Dispatch(hook, eventTypes.WebHookDelivery{ID: "delivery-2"})
+}
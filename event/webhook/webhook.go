@@ -7,18 +7,25 @@ package webhook
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	uuid "github.com/satori/go.uuid"
 	"github.com/tsuru/tsuru/api/shutdown"
 	tsuruErrors "github.com/tsuru/tsuru/errors"
 	"github.com/tsuru/tsuru/event"
@@ -32,9 +39,18 @@ import (
 var (
 	_ eventTypes.WebHookService = &webHookService{}
 
-	chanBufferSize   = 1000
 	defaultUserAgent = "tsuru-webhook-client/1.0"
 
+	// backoff parameters for retrying failed deliveries.
+	retryBaseDelay   = 2 * time.Second
+	retryMaxDelay    = 10 * time.Minute
+	retryMaxAttempts = 8
+
+	// scanInterval is how often run() polls storage for deliveries that
+	// became ready to be (re)attempted.
+	scanInterval = 5 * time.Second
+	scanBatch    = 50
+
 	webhooksLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name: "tsuru_webhooks_latency_seconds",
 		Help: "The latency for webhooks requests in seconds",
@@ -42,7 +58,7 @@ var (
 
 	webhooksQueue = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "tsuru_webhooks_event_queue_current",
-		Help: "The current number of queued events waiting for webhooks processing",
+		Help: "The number of deliveries that were ready for (re)attempt on the last storage scan",
 	})
 
 	webhooksTotal = prometheus.NewCounter(prometheus.CounterOpts{
@@ -54,6 +70,16 @@ var (
 		Name: "tsuru_webhooks_calls_error",
 		Help: "The total number of webhooks calls with error",
 	})
+
+	webhooksDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsuru_webhooks_deliveries_total",
+		Help: "The total number of webhook deliveries, split by outcome",
+	}, []string{"outcome"})
+
+	webhooksCircuitOpen = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tsuru_webhooks_circuit_open_total",
+		Help: "The total number of times a webhook's circuit breaker opened",
+	})
 )
 
 func WebHookService() (eventTypes.WebHookService, error) {
@@ -66,10 +92,11 @@ func WebHookService() (eventTypes.WebHookService, error) {
 	}
 	s := &webHookService{
 		storage: dbDriver.WebHookStorage,
-		evtCh:   make(chan string, chanBufferSize),
+		wakeCh:  make(chan struct{}, 1),
 		quitCh:  make(chan struct{}),
 		doneCh:  make(chan struct{}),
 	}
+	s.dispatch = newDispatcher(s.attemptDelivery)
 	go s.run()
 	shutdown.Register(s)
 	return s, nil
@@ -77,9 +104,15 @@ func WebHookService() (eventTypes.WebHookService, error) {
 
 type webHookService struct {
 	storage eventTypes.WebHookStorage
-	evtCh   chan string
-	quitCh  chan struct{}
-	doneCh  chan struct{}
+	// wakeCh only ever carries a wake-up signal, never event data: by the
+	// time anything touches it, Notify has already durably persisted the
+	// deliveries, so a dropped/overwritten signal just means the next
+	// scanInterval tick picks up the work instead of it happening
+	// immediately.
+	wakeCh   chan struct{}
+	quitCh   chan struct{}
+	doneCh   chan struct{}
+	dispatch *dispatcher
 }
 
 func (s *webHookService) Shutdown(ctx context.Context) error {
@@ -93,31 +126,42 @@ func (s *webHookService) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// Notify persists a WebHookDelivery record per matching hook for evtID
+// before returning, so that storage -- not process memory -- is the
+// source of truth for pending work: a crash right after Notify returns
+// loses nothing, since every delivery it created is already durable. It
+// then nudges run() to pick the new deliveries up immediately instead of
+// waiting for the next scanInterval tick.
 func (s *webHookService) Notify(evtID string) {
+	if err := s.enqueueDeliveries(evtID); err != nil {
+		log.Errorf("[webhooks] error enqueueing deliveries for event %s: %v", evtID, err)
+	}
 	select {
-	case s.evtCh <- evtID:
-	case <-s.quitCh:
+	case s.wakeCh <- struct{}{}:
+	default:
 	}
-	webhooksQueue.Set(float64(len(s.evtCh)))
 }
 
 func (s *webHookService) run() {
 	defer close(s.doneCh)
+	ticker := time.NewTicker(scanInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case evtID := <-s.evtCh:
-			webhooksQueue.Set(float64(len(s.evtCh)))
-			err := s.handleEvent(evtID)
-			if err != nil {
-				log.Errorf("[webhooks] error handling webhooks for event %s", evtID)
-			}
+		case <-s.wakeCh:
+			s.processReadyDeliveries()
+		case <-ticker.C:
+			s.processReadyDeliveries()
 		case <-s.quitCh:
 			return
 		}
 	}
 }
 
-func (s *webHookService) handleEvent(evtID string) error {
+// enqueueDeliveries resolves which hooks are interested in evtID and
+// persists a WebHookDelivery record per matching hook, ready to be picked
+// up by processReadyDeliveries.
+func (s *webHookService) enqueueDeliveries(evtID string) error {
 	evt, err := event.GetByID(bson.ObjectId(evtID))
 	if err != nil {
 		return err
@@ -136,18 +180,200 @@ func (s *webHookService) handleEvent(evtID string) error {
 	if err != nil {
 		return err
 	}
+	now := time.Now().UTC()
 	for _, h := range hooks {
-		err = s.doHook(h, evt)
-		if err != nil {
-			log.Errorf("[webhooks] error calling webhook %q: %v", h.Name, err)
+		delivery := eventTypes.WebHookDelivery{
+			ID:          bson.NewObjectId().Hex(),
+			HookName:    h.Name,
+			EventID:     evtID,
+			State:       eventTypes.WebHookDeliveryStatePending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err = s.storage.InsertDelivery(delivery); err != nil {
+			log.Errorf("[webhooks] error persisting delivery for webhook %q: %v", h.Name, err)
 		}
 	}
 	return nil
 }
 
-func webhookBody(hook *eventTypes.WebHook, evt *event.Event) (io.Reader, error) {
+// processReadyDeliveries pulls every delivery whose NextAttempt has
+// already elapsed and hands each to its hook's dispatcher (see
+// dispatch.go), rescheduling on failure.
+func (s *webHookService) processReadyDeliveries() {
+	deliveries, err := s.storage.FindReadyDeliveries(time.Now().UTC(), scanBatch)
+	if err != nil {
+		log.Errorf("[webhooks] error listing ready deliveries: %v", err)
+		return
+	}
+	webhooksQueue.Set(float64(len(deliveries)))
+	for _, d := range deliveries {
+		hook, err := s.storage.FindByName(d.HookName)
+		if err != nil {
+			d.State = eventTypes.WebHookDeliveryStateCanceled
+			d.LastError = fmt.Sprintf("webhook removed: %v", err)
+			d.UpdatedAt = time.Now().UTC()
+			s.saveDelivery(d)
+			continue
+		}
+		s.dispatch.Dispatch(*hook, d)
+	}
+}
+
+func (s *webHookService) attemptDelivery(d eventTypes.WebHookDelivery) {
+	hook, err := s.storage.FindByName(d.HookName)
+	if err != nil {
+		d.State = eventTypes.WebHookDeliveryStateCanceled
+		d.LastError = fmt.Sprintf("webhook removed: %v", err)
+		d.UpdatedAt = time.Now().UTC()
+		s.saveDelivery(d)
+		return
+	}
+	breaker := s.dispatch.Breaker(hook.Name)
+	if breaker != nil && !breaker.Allow() {
+		// A breaker-skip still counts as a consumed attempt: otherwise a
+		// durably-down endpoint keeps every other pending delivery looping
+		// through this branch forever, never reaching the dead-letter cap.
+		d.Attempts++
+		d.LastError = "circuit breaker open, skipping attempt"
+		d.UpdatedAt = time.Now().UTC()
+		if d.Attempts >= retryMaxAttempts {
+			d.State = eventTypes.WebHookDeliveryStateDeadLetter
+			webhooksDeliveries.WithLabelValues("dead_letter").Inc()
+			log.Errorf("[webhooks] delivery %s to webhook %q moved to dead-letter after %d attempts with circuit breaker open", d.ID, d.HookName, d.Attempts)
+			s.saveDelivery(d)
+			return
+		}
+		d.State = eventTypes.WebHookDeliveryStatePending
+		d.NextAttempt = time.Now().UTC().Add(circuitBreakerOpenDuration)
+		webhooksDeliveries.WithLabelValues("retry").Inc()
+		s.saveDelivery(d)
+		return
+	}
+	evt, err := event.GetByID(bson.ObjectId(d.EventID))
+	if err != nil {
+		d.State = eventTypes.WebHookDeliveryStateCanceled
+		d.LastError = fmt.Sprintf("event no longer available: %v", err)
+		d.UpdatedAt = time.Now().UTC()
+		s.saveDelivery(d)
+		return
+	}
+	d.Attempts++
+	statusCode, respSnippet, retryAfter, hookErr := s.doHook(*hook, evt)
+	d.LastStatus = statusCode
+	d.LastResponse = respSnippet
+	d.UpdatedAt = time.Now().UTC()
+	if hookErr == nil {
+		if breaker != nil {
+			breaker.RecordSuccess()
+		}
+		d.State = eventTypes.WebHookDeliveryStateSuccess
+		d.LastError = ""
+		webhooksDeliveries.WithLabelValues("success").Inc()
+		s.saveDelivery(d)
+		return
+	}
+	if breaker != nil && breaker.RecordFailure() {
+		webhooksCircuitOpen.Inc()
+		log.Errorf("[webhooks] circuit breaker opened for webhook %q after repeated failures", d.HookName)
+	}
+	d.LastError = hookErr.Error()
+	if isTerminal(statusCode, hookErr) || d.Attempts >= retryMaxAttempts {
+		d.State = eventTypes.WebHookDeliveryStateDeadLetter
+		webhooksDeliveries.WithLabelValues("dead_letter").Inc()
+		log.Errorf("[webhooks] delivery %s to webhook %q moved to dead-letter after %d attempts: %v", d.ID, d.HookName, d.Attempts, hookErr)
+		s.saveDelivery(d)
+		return
+	}
+	d.State = eventTypes.WebHookDeliveryStatePending
+	d.NextAttempt = time.Now().UTC().Add(backoffDelay(d.Attempts, retryAfter))
+	webhooksDeliveries.WithLabelValues("retry").Inc()
+	s.saveDelivery(d)
+}
+
+func (s *webHookService) saveDelivery(d eventTypes.WebHookDelivery) {
+	if err := s.storage.UpdateDelivery(d); err != nil {
+		log.Errorf("[webhooks] error persisting delivery %s: %v", d.ID, err)
+	}
+}
+
+// isTerminal reports whether a given outcome should not be retried: any 4xx
+// other than 408 (timeout) and 429 (rate limited) is considered a
+// permanent, non-retryable failure.
+func isTerminal(statusCode int, err error) bool {
+	if statusCode == 0 {
+		return false
+	}
+	if statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
+}
+
+// backoffDelay computes an exponential backoff with jitter for the given
+// attempt number, honoring an explicit Retry-After delay when present.
+func backoffDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > retryMaxDelay {
+			return retryMaxDelay
+		}
+		return retryAfter
+	}
+	delay := retryBaseDelay * time.Duration(1<<uint(attempt-1))
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// templateFuncs are the functions available to hook.Body templates.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	},
+	"jsonEscape": func(s string) (string, error) {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return "", err
+		}
+		quoted := string(data)
+		return quoted[1 : len(quoted)-1], nil
+	},
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// webhookBody renders the payload to be sent to hook for evt. When
+// hook.Body contains a `{{` it is evaluated as a text/template over evt,
+// which lets users shape payloads for third-party systems (Slack, Teams,
+// Opsgenie...) without an intermediary translator service. Otherwise,
+// hook.Body is sent verbatim for backward compatibility. When Body is
+// empty, POST, PUT and PATCH hooks get the raw JSON encoding of evt and
+// hooks with any other method get no body at all.
+func webhookBody(hook *eventTypes.WebHook, evt *event.Event) ([]byte, error) {
 	if hook.Body != "" {
-		return strings.NewReader(hook.Body), nil
+		if !strings.Contains(hook.Body, "{{") {
+			return []byte(hook.Body), nil
+		}
+		tmpl, err := template.New("webhook-body").Funcs(templateFuncs).Parse(hook.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse webhook body template")
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, evt); err != nil {
+			return nil, errors.Wrap(err, "unable to render webhook body template")
+		}
+		return buf.Bytes(), nil
 	}
 	if hook.Method != http.MethodPost &&
 		hook.Method != http.MethodPut &&
@@ -155,14 +381,22 @@ func webhookBody(hook *eventTypes.WebHook, evt *event.Event) (io.Reader, error)
 		return nil, nil
 	}
 	hook.Headers.Set("Content-Type", "application/json")
-	data, err := json.Marshal(evt)
-	if err != nil {
-		return nil, err
-	}
-	return bytes.NewReader(data), nil
+	return json.Marshal(evt)
 }
 
-func (s *webHookService) doHook(hook eventTypes.WebHook, evt *event.Event) (err error) {
+// signBody computes the HMAC-SHA256 signature of body using hook.Secret,
+// in the same hex(hmac(secret, body)) format used by GitHub/GitLab
+// webhooks.
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// doHook performs the HTTP call for hook/evt and returns the response
+// status code, a short snippet (at most 1KiB) of the response body, a Retry-After delay
+// when the server provided one, and an error describing any failure.
+func (s *webHookService) doHook(hook eventTypes.WebHook, evt *event.Event) (statusCode int, respSnippet string, retryAfter time.Duration, err error) {
 	defer func() {
 		webhooksTotal.Inc()
 		if err != nil {
@@ -175,16 +409,22 @@ func (s *webHookService) doHook(hook eventTypes.WebHook, evt *event.Event) (err
 	}
 	body, err := webhookBody(&hook, evt)
 	if err != nil {
-		return err
+		return 0, "", 0, err
 	}
-	req, err := http.NewRequest(hook.Method, hook.URL, body)
+	req, err := http.NewRequest(hook.Method, hook.URL, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return 0, "", 0, err
 	}
 	req.Header = hook.Headers
 	if req.UserAgent() == "" {
 		req.Header.Set("User-Agent", defaultUserAgent)
 	}
+	req.Header.Set("X-Tsuru-Event", evt.Kind.Name)
+	req.Header.Set("X-Tsuru-Delivery", uuid.NewV4().String())
+	req.Header.Set("X-Tsuru-Target", fmt.Sprintf("%s:%s", evt.Target.Type, evt.Target.Value))
+	if hook.Secret != "" {
+		req.Header.Set("X-Tsuru-Signature-256", "sha256="+signBody(hook.Secret, body))
+	}
 	client := tsuruNet.Dial5Full60ClientNoKeepAlive
 	if hook.Insecure {
 		client = &tsuruNet.Dial5Full60ClientNoKeepAliveInsecure
@@ -193,14 +433,19 @@ func (s *webHookService) doHook(hook eventTypes.WebHook, evt *event.Event) (err
 	rsp, err := client.Do(req)
 	webhooksLatency.Observe(time.Since(reqStart).Seconds())
 	if err != nil {
-		return err
+		return 0, "", 0, err
 	}
 	defer rsp.Body.Close()
+	if secs, parseErr := strconv.Atoi(rsp.Header.Get("Retry-After")); parseErr == nil {
+		retryAfter = time.Duration(secs) * time.Second
+	}
 	if rsp.StatusCode < 200 || rsp.StatusCode >= 400 {
-		data, _ := ioutil.ReadAll(rsp.Body)
-		return errors.Errorf("invalid status code calling hook: %d: %s", rsp.StatusCode, string(data))
+		const maxRespSnippet = 1024
+		data, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, maxRespSnippet))
+		respSnippet = string(data)
+		return rsp.StatusCode, respSnippet, retryAfter, errors.Errorf("invalid status code calling hook: %d: %s", rsp.StatusCode, respSnippet)
 	}
-	return nil
+	return rsp.StatusCode, "", 0, nil
 }
 
 func validateURL(u string) error {
@@ -231,16 +476,30 @@ func (s *webHookService) Create(w eventTypes.WebHook) error {
 	return s.storage.Insert(w)
 }
 
+// Update persists w and evicts its dispatcher runtime, if any, so that a
+// changed Concurrency/RatePerMinute/Burst takes effect on the hook's next
+// dispatched delivery instead of only after a process restart.
 func (s *webHookService) Update(w eventTypes.WebHook) error {
 	err := validateURL(w.URL)
 	if err != nil {
 		return err
 	}
-	return s.storage.Update(w)
+	if err = s.storage.Update(w); err != nil {
+		return err
+	}
+	s.dispatch.Evict(w.Name)
+	return nil
 }
 
+// Delete removes the hook and evicts its dispatcher runtime, if any, so
+// its worker goroutines and channel are torn down instead of leaking for
+// the remaining lifetime of the process.
 func (s *webHookService) Delete(name string) error {
-	return s.storage.Delete(name)
+	if err := s.storage.Delete(name); err != nil {
+		return err
+	}
+	s.dispatch.Evict(name)
+	return nil
 }
 
 func (s *webHookService) Find(name string) (eventTypes.WebHook, error) {
@@ -253,4 +512,45 @@ func (s *webHookService) Find(name string) (eventTypes.WebHook, error) {
 
 func (s *webHookService) List(teams []string) ([]eventTypes.WebHook, error) {
 	return s.storage.FindAllByTeams(teams)
-}
\ No newline at end of file
+}
+
+// ListDeliveries returns every delivery attempt recorded for hookName,
+// regardless of state, for inspection purposes.
+func (s *webHookService) ListDeliveries(hookName string) ([]eventTypes.WebHookDelivery, error) {
+	return s.storage.FindDeliveriesByHook(hookName)
+}
+
+// GetDelivery returns a single delivery by its id.
+func (s *webHookService) GetDelivery(id string) (eventTypes.WebHookDelivery, error) {
+	d, err := s.storage.FindDeliveryByID(id)
+	if err != nil {
+		return eventTypes.WebHookDelivery{}, err
+	}
+	return *d, nil
+}
+
+// RetryDelivery schedules an immediate retry of a delivery, regardless of
+// its current state. It is the operator-facing escape hatch for replaying
+// deliveries that landed in the dead-letter state.
+func (s *webHookService) RetryDelivery(id string) error {
+	d, err := s.storage.FindDeliveryByID(id)
+	if err != nil {
+		return err
+	}
+	d.State = eventTypes.WebHookDeliveryStatePending
+	d.NextAttempt = time.Now().UTC()
+	d.UpdatedAt = d.NextAttempt
+	return s.storage.UpdateDelivery(*d)
+}
+
+// CancelDelivery marks a pending delivery as canceled so it is no longer
+// picked up by processReadyDeliveries.
+func (s *webHookService) CancelDelivery(id string) error {
+	d, err := s.storage.FindDeliveryByID(id)
+	if err != nil {
+		return err
+	}
+	d.State = eventTypes.WebHookDeliveryStateCanceled
+	d.UpdatedAt = time.Now().UTC()
+	return s.storage.UpdateDelivery(*d)
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsTerminal(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		terminal   bool
+	}{
+		{0, false},
+		{http.StatusOK, false},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+	}
+	for _, c := range cases {
+		got := isTerminal(c.statusCode, errors.New("some error"))
+		if got != c.terminal {
+			t.Errorf("isTerminal(%d): expected %v, got %v", c.statusCode, c.terminal, got)
+		}
+	}
+}
+
+func TestBackoffDelayHonorsRetryAfter(t *testing.T) {
+	delay := backoffDelay(1, 5*time.Second)
+	if delay != 5*time.Second {
+		t.Errorf("expected retryAfter to be used verbatim, got %s", delay)
+	}
+}
+
+func TestBackoffDelayCapsRetryAfterAtMax(t *testing.T) {
+	delay := backoffDelay(1, 20*time.Minute)
+	if delay != retryMaxDelay {
+		t.Errorf("expected retryAfter to be capped at %s, got %s", retryMaxDelay, delay)
+	}
+}
+
+func TestBackoffDelayGrowsWithAttemptsAndCaps(t *testing.T) {
+	for attempt := 1; attempt <= retryMaxAttempts; attempt++ {
+		base := retryBaseDelay * time.Duration(uint64(1)<<uint(attempt-1))
+		wantMin, wantMax := base/2, base
+		if base > retryMaxDelay || base <= 0 {
+			wantMin, wantMax = retryMaxDelay/2, retryMaxDelay
+		}
+		delay := backoffDelay(attempt, 0)
+		if delay < wantMin || delay >= wantMax {
+			t.Fatalf("attempt %d: delay %s outside expected [%s, %s)", attempt, delay, wantMin, wantMax)
+		}
+		if delay > retryMaxDelay {
+			t.Fatalf("attempt %d: delay %s exceeds retryMaxDelay %s", attempt, delay, retryMaxDelay)
+		}
+	}
+}
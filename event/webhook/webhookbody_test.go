@@ -0,0 +1,105 @@
+// Copyright 2018 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tsuru/tsuru/event"
+	eventTypes "github.com/tsuru/tsuru/types/event"
+)
+
+func sampleEvent() *event.Event {
+	evt := &event.Event{}
+	evt.Target.Type = "app"
+	evt.Target.Value = "myapp"
+	evt.Kind.Type = "permission"
+	evt.Kind.Name = "app.update.env.set"
+	return evt
+}
+
+func TestWebhookBodyRawPassthrough(t *testing.T) {
+	hook := &eventTypes.WebHook{Body: "plain text, no templating here", Headers: http.Header{}}
+	body, err := webhookBody(hook, sampleEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != hook.Body {
+		t.Errorf("expected raw body to pass through unchanged, got %q", string(body))
+	}
+}
+
+func TestWebhookBodyTemplate(t *testing.T) {
+	hook := &eventTypes.WebHook{
+		Body:    `{"target":"{{jsonEscape .Target.Value}}","kind":{{json .Kind.Name}},"note":"{{default "n/a" ""}}"}`,
+		Headers: http.Header{},
+	}
+	body, err := webhookBody(hook, sampleEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]string
+	if err = json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("rendered body is not valid JSON: %v (body: %s)", err, body)
+	}
+	if decoded["target"] != "myapp" {
+		t.Errorf("expected target myapp, got %q", decoded["target"])
+	}
+	if decoded["kind"] != "app.update.env.set" {
+		t.Errorf("expected kind app.update.env.set, got %q", decoded["kind"])
+	}
+	if decoded["note"] != "n/a" {
+		t.Errorf("expected default to fill in n/a, got %q", decoded["note"])
+	}
+}
+
+func TestWebhookBodyEmptyFallsBackToJSONEncoding(t *testing.T) {
+	hook := &eventTypes.WebHook{Method: http.MethodPost, Headers: http.Header{}}
+	body, err := webhookBody(hook, sampleEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded event.Event
+	if err = json.Unmarshal(body, &decoded); err != nil {
+		t.Fatalf("expected valid JSON encoding of the event, got error: %v", err)
+	}
+	if ct := hook.Headers.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type to be set to application/json, got %q", ct)
+	}
+}
+
+func TestWebhookBodyEmptyGetHasNoBody(t *testing.T) {
+	hook := &eventTypes.WebHook{Method: http.MethodGet, Headers: http.Header{}}
+	body, err := webhookBody(hook, sampleEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		t.Errorf("expected no body for a GET hook, got %q", body)
+	}
+}
+
+func TestSignBody(t *testing.T) {
+	secret := "s3cr3t"
+	body := []byte(`{"hello":"world"}`)
+	got := signBody(secret, body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if got != want {
+		t.Errorf("expected signature %q, got %q", want, got)
+	}
+	if strings.Contains(got, secret) {
+		t.Errorf("signature must not leak the secret, got %q", got)
+	}
+}
@@ -9,16 +9,143 @@ package router
 
 import (
 	"context"
+	"fmt"
 )
 
+// HeaderMatch selects traffic for a prefix based on an exact request
+// header match, used with RoutingStrategyHeader.
+type HeaderMatch struct {
+	Name  string
+	Value string
+}
+
+// CookieMatch selects traffic for a prefix based on an exact cookie
+// match, used with RoutingStrategyHeader.
+type CookieMatch struct {
+	Name  string
+	Value string
+}
+
 type BackendPrefix struct {
 	Prefix string
 	Target map[string]string // in kubernetes cluster be like {serviceName: "", namespace: ""}
+
+	// Weight is the relative share of traffic this prefix should receive
+	// when EnsureBackendOpts.Strategy is RoutingStrategyWeighted. Prefixes
+	// without a Weight split the remaining traffic evenly.
+	Weight *uint32
+
+	// Header, when set, routes requests matching it to this prefix,
+	// regardless of Weight. Used with RoutingStrategyHeader.
+	Header *HeaderMatch
+
+	// Cookie, when set, routes requests matching it to this prefix,
+	// regardless of Weight. Used with RoutingStrategyHeader.
+	Cookie *CookieMatch
+
+	// Middlewares is an ordered list of names previously registered with
+	// RouterV2.EnsureMiddleware, applied to requests hitting this prefix
+	// in the given order.
+	Middlewares []string
+}
+
+// MiddlewareKind enumerates the built-in, cross-router middleware
+// vocabulary. Each router implementation maps these to its own native
+// primitives (nginx-ingress annotations, Istio EnvoyFilter, Gateway API
+// filters, ...).
+type MiddlewareKind string
+
+const (
+	MiddlewareRateLimit      = MiddlewareKind("rate-limit")
+	MiddlewareIPAllowlist    = MiddlewareKind("ip-allowlist")
+	MiddlewareBasicAuth      = MiddlewareKind("basic-auth")
+	MiddlewareForwardAuth    = MiddlewareKind("forward-auth")
+	MiddlewareRedirectScheme = MiddlewareKind("redirect-scheme")
+	MiddlewareStripPrefix    = MiddlewareKind("strip-prefix")
+	MiddlewareAddHeaders     = MiddlewareKind("add-headers")
+	MiddlewareRetry          = MiddlewareKind("retry")
+	MiddlewareCircuitBreaker = MiddlewareKind("circuit-breaker")
+)
+
+// MiddlewareSpec is the portable description of a middleware instance,
+// addressable by name from BackendPrefix.Middlewares. Spec holds
+// kind-specific configuration; call Validate before passing a
+// MiddlewareSpec to EnsureMiddleware to check it carries the keys its
+// Kind requires.
+type MiddlewareSpec struct {
+	Name string
+	Kind MiddlewareKind
+	Spec map[string]interface{}
+}
+
+// middlewareRequiredKeys lists, per MiddlewareKind, the Spec keys that
+// must be present for the middleware to be meaningfully configured.
+var middlewareRequiredKeys = map[MiddlewareKind][]string{
+	MiddlewareRateLimit:      {"requestsPerSecond"},
+	MiddlewareIPAllowlist:    {"cidrs"},
+	MiddlewareBasicAuth:      {"users"},
+	MiddlewareForwardAuth:    {"address"},
+	MiddlewareRedirectScheme: {"scheme"},
+	MiddlewareStripPrefix:    {"prefixes"},
+	MiddlewareAddHeaders:     {"headers"},
+	MiddlewareRetry:          {"attempts"},
+	MiddlewareCircuitBreaker: {"maxFailures"},
 }
 
+// Validate checks that Name and Kind are set and that Spec carries the
+// keys required for Kind, per middlewareRequiredKeys. It does not
+// validate the keys' values, which remain router-implementation specific.
+func (m MiddlewareSpec) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("middleware name must not be empty")
+	}
+	required, ok := middlewareRequiredKeys[m.Kind]
+	if !ok {
+		return fmt.Errorf("unknown middleware kind: %q", m.Kind)
+	}
+	for _, key := range required {
+		if _, ok = m.Spec[key]; !ok {
+			return fmt.Errorf("middleware %q of kind %q is missing required spec key %q", m.Name, m.Kind, key)
+		}
+	}
+	return nil
+}
+
+// RoutingStrategy selects how traffic is distributed between the prefixes
+// of a backend.
+type RoutingStrategy string
+
+const (
+	// RoutingStrategyWeighted splits traffic across prefixes according to
+	// their relative BackendPrefix.Weight, enabling blue/green and canary
+	// rollouts.
+	RoutingStrategyWeighted = RoutingStrategy("weighted")
+
+	// RoutingStrategyHeader routes traffic based on each prefix's Header
+	// or Cookie match criteria.
+	RoutingStrategyHeader = RoutingStrategy("header")
+
+	// RoutingStrategyMirror duplicates traffic to every prefix, discarding
+	// the mirrored responses, for shadow testing a new version.
+	RoutingStrategyMirror = RoutingStrategy("mirror")
+)
+
 type EnsureBackendOpts struct {
 	Opts     map[string]interface{}
 	Prefixes []BackendPrefix
+
+	// Strategy controls how traffic is split across Prefixes. It defaults
+	// to RoutingStrategyWeighted when empty.
+	Strategy RoutingStrategy
+}
+
+// BackendStatus reports the observed state of a single prefix of a
+// backend, so that progressive rollout controllers can confirm a weight
+// change has taken effect before moving on.
+type BackendStatus struct {
+	Prefix        string
+	Weight        uint32
+	ReadyReplicas int32
 }
 
 // RouterV2 is specialized in clustered router environments like kubernetes
@@ -26,3 +153,33 @@ type EnsureBackendOpts struct {
 type RouterV2 interface {
 	EnsureBackend(ctx context.Context, app App, o EnsureBackendOpts) error
 }
+
+// RouterV2Status is implemented by RouterV2 backends that can report
+// observed rollout state. It is kept separate from RouterV2 itself so
+// that existing implementations keep building unmodified; callers use a
+// type assertion to discover support for it, e.g.:
+//
+//	if sr, ok := router.(RouterV2Status); ok {
+//		statuses, err := sr.Status(ctx, app)
+//	}
+type RouterV2Status interface {
+	// Status returns the observed per-prefix weight and ready replica
+	// counts for app's backend, allowing callers to drive progressive
+	// rollouts (e.g. canary, blue/green) and confirm convergence.
+	Status(ctx context.Context, app App) ([]BackendStatus, error)
+}
+
+// RouterV2MiddlewareManager is implemented by RouterV2 backends that
+// support the middleware pipeline. It is kept separate from RouterV2
+// itself so that existing implementations keep building unmodified;
+// callers use a type assertion to discover support for it, the same way
+// as for RouterV2Status.
+type RouterV2MiddlewareManager interface {
+	// EnsureMiddleware creates or updates a named middleware, making it
+	// referenceable from BackendPrefix.Middlewares. name is scoped to app.
+	EnsureMiddleware(ctx context.Context, app App, name string, spec MiddlewareSpec) error
+
+	// DeleteMiddleware removes a previously created middleware. Backends
+	// still referencing it should have it dropped from their pipeline.
+	DeleteMiddleware(ctx context.Context, app App, name string) error
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+)
+
+func TestMiddlewareSpecValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    MiddlewareSpec
+		wantErr bool
+	}{
+		{
+			name:    "empty name",
+			spec:    MiddlewareSpec{Kind: MiddlewareRateLimit, Spec: map[string]interface{}{"requestsPerSecond": 10}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown kind",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareKind("does-not-exist"), Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "rate-limit missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRateLimit, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "rate-limit valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRateLimit, Spec: map[string]interface{}{"requestsPerSecond": 10}},
+			wantErr: false,
+		},
+		{
+			name:    "ip-allowlist valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareIPAllowlist, Spec: map[string]interface{}{"cidrs": []string{"10.0.0.0/8"}}},
+			wantErr: false,
+		},
+		{
+			name:    "ip-allowlist missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareIPAllowlist, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "basic-auth valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareBasicAuth, Spec: map[string]interface{}{"users": "admin:secret"}},
+			wantErr: false,
+		},
+		{
+			name:    "basic-auth missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareBasicAuth, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "forward-auth valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareForwardAuth, Spec: map[string]interface{}{"address": "http://auth"}},
+			wantErr: false,
+		},
+		{
+			name:    "forward-auth missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareForwardAuth, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "redirect-scheme valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRedirectScheme, Spec: map[string]interface{}{"scheme": "https"}},
+			wantErr: false,
+		},
+		{
+			name:    "redirect-scheme missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRedirectScheme, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "strip-prefix valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareStripPrefix, Spec: map[string]interface{}{"prefixes": []string{"/api"}}},
+			wantErr: false,
+		},
+		{
+			name:    "strip-prefix missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareStripPrefix, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "add-headers valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareAddHeaders, Spec: map[string]interface{}{"headers": map[string]string{"X-Foo": "bar"}}},
+			wantErr: false,
+		},
+		{
+			name:    "add-headers missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareAddHeaders, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "retry valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRetry, Spec: map[string]interface{}{"attempts": 3}},
+			wantErr: false,
+		},
+		{
+			name:    "retry missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareRetry, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+		{
+			name:    "circuit-breaker valid",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareCircuitBreaker, Spec: map[string]interface{}{"maxFailures": 5}},
+			wantErr: false,
+		},
+		{
+			name:    "circuit-breaker missing required key",
+			spec:    MiddlewareSpec{Name: "m1", Kind: MiddlewareCircuitBreaker, Spec: map[string]interface{}{}},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.spec.Validate()
+			if c.wantErr && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
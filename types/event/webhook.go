@@ -0,0 +1,107 @@
+// Copyright 2021 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"net/http"
+	"time"
+)
+
+// WebHookEventFilter describes which events a WebHook is interested in.
+type WebHookEventFilter struct {
+	TargetTypes  []string
+	TargetValues []string
+	KindTypes    []string
+	KindNames    []string
+	ErrorOnly    bool
+	SuccessOnly  bool
+}
+
+// WebHook is the user configured subscription for a given set of events,
+// which results in an HTTP call to URL every time a matching event happens.
+type WebHook struct {
+	Name        string `bson:"_id"`
+	Description string
+	TeamOwner   string
+	EventFilter WebHookEventFilter
+	URL         string
+	Headers     http.Header
+	Method      string
+	Body        string
+	Insecure    bool
+	// Secret, when set, is used to sign outgoing requests with an
+	// X-Tsuru-Signature-256 HMAC header so receivers can verify authenticity.
+	Secret string
+	// Concurrency limits how many deliveries for this hook may be
+	// in-flight at once. Defaults to 1 (serial) when zero.
+	Concurrency int
+	// RatePerMinute, when greater than zero, caps how many deliveries per
+	// minute are attempted for this hook, smoothed through a token bucket
+	// of size Burst.
+	RatePerMinute int
+	// Burst is the token bucket size used together with RatePerMinute. It
+	// defaults to RatePerMinute when zero.
+	Burst int
+}
+
+// WebHookDeliveryState represents the lifecycle state of a single delivery
+// attempt of an event to a webhook.
+type WebHookDeliveryState string
+
+const (
+	WebHookDeliveryStatePending    = WebHookDeliveryState("pending")
+	WebHookDeliveryStateSuccess    = WebHookDeliveryState("success")
+	WebHookDeliveryStateDeadLetter = WebHookDeliveryState("dead-letter")
+	WebHookDeliveryStateCanceled   = WebHookDeliveryState("canceled")
+)
+
+// WebHookDelivery represents a single (hook, event) delivery and tracks its
+// retry state so it can survive process restarts.
+type WebHookDelivery struct {
+	ID           string `bson:"_id"`
+	HookName     string
+	EventID      string
+	State        WebHookDeliveryState
+	Attempts     int
+	NextAttempt  time.Time
+	LastStatus   int
+	LastResponse string
+	LastError    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// WebHookService manages the webhook subscriptions and drives the delivery
+// of events to them.
+type WebHookService interface {
+	Notify(evtID string)
+	Create(webhook WebHook) error
+	Update(webhook WebHook) error
+	Delete(name string) error
+	Find(name string) (WebHook, error)
+	List(teams []string) ([]WebHook, error)
+
+	ListDeliveries(hookName string) ([]WebHookDelivery, error)
+	GetDelivery(id string) (WebHookDelivery, error)
+	RetryDelivery(id string) error
+	CancelDelivery(id string) error
+}
+
+// WebHookStorage is the persistence layer for webhooks and their
+// deliveries.
+type WebHookStorage interface {
+	Insert(WebHook) error
+	Update(WebHook) error
+	Delete(name string) error
+	FindByName(name string) (*WebHook, error)
+	FindAllByTeams(teams []string) ([]WebHook, error)
+	FindByEvent(filter WebHookEventFilter, isSuccess bool) ([]WebHook, error)
+
+	InsertDelivery(WebHookDelivery) error
+	UpdateDelivery(WebHookDelivery) error
+	FindDeliveryByID(id string) (*WebHookDelivery, error)
+	FindReadyDeliveries(now time.Time, limit int) ([]WebHookDelivery, error)
+	FindDeliveriesByHook(hookName string) ([]WebHookDelivery, error)
+}